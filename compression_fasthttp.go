@@ -0,0 +1,348 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// errInvalidWindowBits is returned when a client-offered max_window_bits
+// parameter falls outside the 9-15 range allowed by RFC 7692 section 7.1.2.1.
+var errInvalidWindowBits = errors.New("websocket: invalid max_window_bits value")
+
+// PerMessageDeflate configures the permessage-deflate extension (RFC 7692)
+// that UpgraderFs offers when EnableCompression is true. The zero value adds
+// no parameter of its own: it accepts the client's offer as made, so context
+// takeover stays enabled in each direction unless the client asks for
+// server_no_context_takeover or client_no_context_takeover.
+type PerMessageDeflate struct {
+	// ServerNoContextTakeover forces the server's compressor to discard its
+	// LZ77 window at the end of every message. Use this to bound per-
+	// connection memory at the cost of compression ratio.
+	ServerNoContextTakeover bool
+
+	// ClientNoContextTakeover asks the client to do the same on its side.
+	// It is only a request: RFC 7692 lets the client honor or ignore it.
+	ClientNoContextTakeover bool
+
+	// ServerMaxWindowBits caps the LZ77 window size, in bits, the server's
+	// compressor may use. Valid values are 9-15; zero leaves it unbounded.
+	ServerMaxWindowBits int
+
+	// ClientMaxWindowBits caps the window size the client may use and is
+	// advertised back to the client so it can shrink its own compressor.
+	// Valid values are 9-15; zero leaves it unbounded.
+	ClientMaxWindowBits int
+}
+
+// negotiatePerMessageDeflate applies RFC 7692 section 7.1.2 to the client's
+// offered permessage-deflate parameters, returning the parameters the server
+// accepts and will echo back in its response. ok is false if cfg sets
+// ClientMaxWindowBits but the offer carries no client_max_window_bits
+// parameter, or if the offer carries an invalid max_window_bits value.
+func negotiatePerMessageDeflate(offer map[string]string, cfg PerMessageDeflate) (accepted map[string]string, ok bool) {
+	accepted = make(map[string]string)
+
+	if _, present := offer["server_no_context_takeover"]; present || cfg.ServerNoContextTakeover {
+		accepted["server_no_context_takeover"] = ""
+	}
+	if _, present := offer["client_no_context_takeover"]; present || cfg.ClientNoContextTakeover {
+		accepted["client_no_context_takeover"] = ""
+	}
+
+	if v, present := offer["server_max_window_bits"]; present {
+		bits, err := parseWindowBits(v)
+		if err != nil {
+			return nil, false
+		}
+		if cfg.ServerMaxWindowBits != 0 && cfg.ServerMaxWindowBits < bits {
+			bits = cfg.ServerMaxWindowBits
+		}
+		accepted["server_max_window_bits"] = strconv.Itoa(bits)
+	} else if cfg.ServerMaxWindowBits != 0 {
+		accepted["server_max_window_bits"] = strconv.Itoa(cfg.ServerMaxWindowBits)
+	}
+
+	if v, present := offer["client_max_window_bits"]; present {
+		if v == "" {
+			// A bare "client_max_window_bits" (no "=value") is how most
+			// real clients advertise willingness to honor a server-chosen
+			// cap; it is not the same as the parameter being absent.
+			if cfg.ClientMaxWindowBits != 0 {
+				accepted["client_max_window_bits"] = strconv.Itoa(cfg.ClientMaxWindowBits)
+			}
+		} else {
+			bits, err := parseWindowBits(v)
+			if err != nil {
+				return nil, false
+			}
+			if cfg.ClientMaxWindowBits != 0 && cfg.ClientMaxWindowBits < bits {
+				bits = cfg.ClientMaxWindowBits
+			}
+			accepted["client_max_window_bits"] = strconv.Itoa(bits)
+		}
+	} else if cfg.ClientMaxWindowBits != 0 {
+		// The client never advertised support for a capped window, so we
+		// cannot impose one on it.
+		return nil, false
+	}
+
+	return accepted, true
+}
+
+// parseWindowBits validates a max_window_bits extension parameter.
+func parseWindowBits(v string) (int, error) {
+	bits, err := strconv.Atoi(v)
+	if err != nil || bits <= 8 || bits > 15 {
+		return 0, errInvalidWindowBits
+	}
+	return bits, nil
+}
+
+// formatPerMessageDeflate renders accepted permessage-deflate parameters as
+// a Sec-Websocket-Extensions header value.
+func formatPerMessageDeflate(accepted map[string]string) string {
+	var b strings.Builder
+	b.WriteString("permessage-deflate")
+	for _, k := range [...]string{"server_no_context_takeover", "client_no_context_takeover", "server_max_window_bits", "client_max_window_bits"} {
+		v, present := accepted[k]
+		if !present {
+			continue
+		}
+		b.WriteString("; ")
+		b.WriteString(k)
+		if v != "" {
+			b.WriteString("=")
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
+
+// effectiveCompressionLevel translates UpgraderFs.CompressionLevel's
+// documented zero-value default (flate.DefaultCompression) into the actual
+// value passed to flate.NewWriter. Without this, an UpgraderFs that only
+// sets EnableCompression and leaves CompressionLevel unset would silently
+// get level 0, which is flate.NoCompression (store-only, strictly worse
+// than sending the frame uncompressed) rather than the documented default.
+func effectiveCompressionLevel(level int) int {
+	if level == 0 {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+// trailerTrimWriter passes through all but the trailing four bytes written
+// to it. A persistent flate.Writer emits a 4-byte sync-flush trailer
+// (0x00 0x00 0xff 0xff) on every Flush; context-takeover peers assume that
+// trailer at each message boundary and don't want it duplicated on the
+// wire, so it is held back and silently dropped here.
+//
+// retarget points it at a new underlying io.Writer for the next message. It
+// intentionally does not touch the flate.Writer that writes into it:
+// retargeting only the sink, and never calling flate.Writer.Reset, is what
+// keeps that writer's LZ77 window alive across messages.
+type trailerTrimWriter struct {
+	w   io.Writer
+	n   int
+	buf [4]byte
+}
+
+func (t *trailerTrimWriter) retarget(w io.Writer) {
+	t.w = w
+	t.n = 0
+}
+
+func (t *trailerTrimWriter) Write(p []byte) (int, error) {
+	n := 0
+	if t.n < len(t.buf) {
+		n = copy(t.buf[t.n:], p)
+		p = p[n:]
+		t.n += n
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+	if len(p) < len(t.buf) {
+		// p is shorter than the held-back tail: release only as many held
+		// bytes as p displaces.
+		k := len(p)
+		if _, err := t.w.Write(t.buf[:k]); err != nil {
+			return n, err
+		}
+		copy(t.buf[:], t.buf[k:])
+		copy(t.buf[len(t.buf)-k:], p)
+		return n + k, nil
+	}
+	m, err := t.w.Write(t.buf[:])
+	if err != nil {
+		return n, err
+	}
+	if m != len(t.buf) {
+		return n, io.ErrShortWrite
+	}
+	m, err = t.w.Write(p[:len(p)-4])
+	n += m
+	if err != nil {
+		return n, err
+	}
+	copy(t.buf[:], p[len(p)-4:])
+	n += 4
+	return n, nil
+}
+
+type flateWriteCloser struct {
+	fw *flate.Writer
+}
+
+func (f *flateWriteCloser) Write(p []byte) (int, error) { return f.fw.Write(p) }
+func (f *flateWriteCloser) Close() error                { return f.fw.Flush() }
+
+// newContextTakeoverCompressor returns a newCompressionWriter implementation
+// that keeps a single flate.Writer, and its LZ77 window, alive across every
+// message on one Conn. Each call only retargets the trailerTrimWriter
+// feeding that writer at the new message's io.WriteCloser; it never calls
+// flate.Writer.Reset, which would zero the window and hash tables and throw
+// away exactly the cross-message compression gain context takeover exists
+// for.
+func newContextTakeoverCompressor(level int) func(io.WriteCloser) (io.WriteCloser, error) {
+	tw := &trailerTrimWriter{}
+	var fw *flate.Writer
+	return func(w io.WriteCloser) (io.WriteCloser, error) {
+		tw.retarget(w)
+		if fw == nil {
+			var err error
+			fw, err = flate.NewWriter(tw, level)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &flateWriteCloser{fw: fw}, nil
+	}
+}
+
+// newThresholdCompressionWriter wraps next, a newCompressionWriter
+// implementation, so that messages smaller than threshold bytes bypass
+// compression entirely: deflate's framing overhead can make compression a
+// net loss for small frames. threshold <= 0 disables the bypass.
+func newThresholdCompressionWriter(threshold int, next func(io.WriteCloser) (io.WriteCloser, error)) func(io.WriteCloser) (io.WriteCloser, error) {
+	if threshold <= 0 {
+		return next
+	}
+	return func(w io.WriteCloser) (io.WriteCloser, error) {
+		return &thresholdWriter{threshold: threshold, dst: w, next: next}, nil
+	}
+}
+
+// thresholdWriter buffers a message's bytes until either it is closed
+// (flushing the buffer straight to dst, uncompressed) or it reaches
+// threshold bytes (at which point it hands the buffered prefix, and every
+// write after, to a compressor built from next).
+type thresholdWriter struct {
+	threshold int
+	dst       io.WriteCloser
+	next      func(io.WriteCloser) (io.WriteCloser, error)
+	buf       []byte
+	cw        io.WriteCloser
+}
+
+func (t *thresholdWriter) Write(p []byte) (int, error) {
+	if t.cw != nil {
+		return t.cw.Write(p)
+	}
+	t.buf = append(t.buf, p...)
+	if len(t.buf) < t.threshold {
+		return len(p), nil
+	}
+	cw, err := t.next(t.dst)
+	if err != nil {
+		return 0, err
+	}
+	t.cw = cw
+	if _, err := t.cw.Write(t.buf); err != nil {
+		return 0, err
+	}
+	t.buf = nil
+	return len(p), nil
+}
+
+func (t *thresholdWriter) Close() error {
+	if t.cw != nil {
+		return t.cw.Close()
+	}
+	if len(t.buf) == 0 {
+		return nil
+	}
+	_, err := t.dst.Write(t.buf)
+	t.buf = nil
+	return err
+}
+
+// contextTakeoverTail is appended after the peer's data so that flate.Reader
+// sees the sync-flush trailer a context-takeover compressor never sends on
+// the wire.
+var contextTakeoverTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// maxWindowSize is the largest LZ77 back-reference distance flate supports
+// (2^15, per RFC 1951), and so the most history worth keeping as a preset
+// dictionary between messages.
+const maxWindowSize = 32768
+
+// dictTrackingReader adapts a flate reader to io.Reader, folding the bytes
+// it reads into dict so the next message's Reset call can seed the
+// decompressor with the last message's history. flate.Reader has no way to
+// keep a live decompressor straddling two separate io.Readers (it latches
+// an error once its source returns EOF), so unlike the write side, context
+// takeover here works by re-seeding a fresh Reset with the prior window
+// rather than never calling Reset at all.
+type dictTrackingReader struct {
+	r    io.Reader
+	dict *[]byte
+}
+
+func (d *dictTrackingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if n > 0 {
+		*d.dict = appendWindow(*d.dict, p[:n])
+	}
+	if err == io.ErrUnexpectedEOF {
+		// contextTakeoverTail ends in a final empty block, so a complete
+		// message ends in io.EOF. flate reports io.ErrUnexpectedEOF when
+		// its source ends before a final block; that is returned as
+		// io.EOF as well.
+		err = io.EOF
+	}
+	return n, err
+}
+
+func appendWindow(dict, p []byte) []byte {
+	dict = append(dict, p...)
+	if len(dict) > maxWindowSize {
+		dict = dict[len(dict)-maxWindowSize:]
+	}
+	return dict
+}
+
+// newContextTakeoverDecompressor mirrors newContextTakeoverCompressor on the
+// read side: instead of discarding the LZ77 window at each message
+// boundary, it tracks the decompressed output of the connection in dict and
+// passes it to Reset as a preset dictionary, so each message's back
+// references can still reach into prior messages' data.
+func newContextTakeoverDecompressor() func(io.Reader) io.Reader {
+	var fr io.Reader
+	var resetter flate.Resetter
+	dict := make([]byte, 0, maxWindowSize)
+	return func(r io.Reader) io.Reader {
+		mr := io.MultiReader(r, bytes.NewReader(contextTakeoverTail))
+		if fr == nil {
+			fr = flate.NewReaderDict(mr, dict)
+			resetter = fr.(flate.Resetter)
+		} else {
+			resetter.Reset(mr, dict)
+		}
+		return &dictTrackingReader{r: fr, dict: &dict}
+	}
+}
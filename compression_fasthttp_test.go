@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"compress/flate"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiatePerMessageDeflate(t *testing.T) {
+	cases := []struct {
+		name   string
+		offer  map[string]string
+		cfg    PerMessageDeflate
+		wantOK bool
+		want   map[string]string
+	}{
+		{
+			name:   "plain offer, no config",
+			offer:  map[string]string{},
+			cfg:    PerMessageDeflate{},
+			wantOK: true,
+			want:   map[string]string{},
+		},
+		{
+			name:   "client requests no context takeover",
+			offer:  map[string]string{"client_no_context_takeover": ""},
+			cfg:    PerMessageDeflate{},
+			wantOK: true,
+			want:   map[string]string{"client_no_context_takeover": ""},
+		},
+		{
+			name:   "server forces no context takeover even if client didn't ask",
+			offer:  map[string]string{},
+			cfg:    PerMessageDeflate{ServerNoContextTakeover: true},
+			wantOK: true,
+			want:   map[string]string{"server_no_context_takeover": ""},
+		},
+		{
+			name:   "bare client_max_window_bits is accepted, not treated as absent",
+			offer:  map[string]string{"client_max_window_bits": ""},
+			cfg:    PerMessageDeflate{ClientMaxWindowBits: 12},
+			wantOK: true,
+			want:   map[string]string{"client_max_window_bits": "12"},
+		},
+		{
+			name:   "client_max_window_bits with a value is capped by config",
+			offer:  map[string]string{"client_max_window_bits": "15"},
+			cfg:    PerMessageDeflate{ClientMaxWindowBits: 10},
+			wantOK: true,
+			want:   map[string]string{"client_max_window_bits": "10"},
+		},
+		{
+			name:   "config requires a capped window the client never offered",
+			offer:  map[string]string{},
+			cfg:    PerMessageDeflate{ClientMaxWindowBits: 10},
+			wantOK: false,
+		},
+		{
+			name:   "out of range server_max_window_bits is rejected",
+			offer:  map[string]string{"server_max_window_bits": "8"},
+			cfg:    PerMessageDeflate{},
+			wantOK: false,
+		},
+		{
+			name:   "non-numeric client_max_window_bits is rejected",
+			offer:  map[string]string{"client_max_window_bits": "lots"},
+			cfg:    PerMessageDeflate{},
+			wantOK: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := negotiatePerMessageDeflate(tc.offer, tc.cfg)
+			if ok != tc.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tc.wantOK)
+			}
+			if ok && !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("accepted = %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveCompressionLevel(t *testing.T) {
+	if got := effectiveCompressionLevel(0); got != flate.DefaultCompression {
+		t.Fatalf("effectiveCompressionLevel(0) = %d, want flate.DefaultCompression (%d)", got, flate.DefaultCompression)
+	}
+	if got := effectiveCompressionLevel(9); got != 9 {
+		t.Fatalf("effectiveCompressionLevel(9) = %d, want 9", got)
+	}
+}
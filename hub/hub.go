@@ -0,0 +1,375 @@
+// Package hub implements a topic-based publish/subscribe broker on top of
+// websocket.Conn, for fanning out messages from a single process holding
+// many upgraded fasthttp connections (score updates, user events, and
+// similar broadcast workloads).
+package hub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/vlansco/websocket"
+)
+
+// SlowClientPolicy controls what Publish does when a subscriber's send
+// buffer is full.
+type SlowClientPolicy int
+
+const (
+	// DropOldest discards the oldest buffered message to make room for the
+	// new one. It is the zero value and the default policy.
+	DropOldest SlowClientPolicy = iota
+	// DropNewest discards the message being published instead of a
+	// previously buffered one.
+	DropNewest
+	// CloseSlowClient disconnects the subscriber outright.
+	CloseSlowClient
+)
+
+// Hub fans out published messages to the connections subscribed to a topic.
+// The zero value is not usable; construct one with New.
+type Hub struct {
+	// SendBuffer is the per-connection outgoing buffer size used by
+	// Register. It must be set before the first Register call; changing it
+	// afterward has no effect on already-registered connections.
+	SendBuffer int
+
+	// SlowClientPolicy decides how Publish behaves when a subscriber's
+	// buffer is full. The zero value is DropOldest.
+	SlowClientPolicy SlowClientPolicy
+
+	// OnPublish, OnDrop, and OnDisconnect are optional metrics hooks. They
+	// are called synchronously from Publish/the write pump, so they must
+	// not block.
+	OnPublish    func(topic string, delivered int)
+	OnDrop       func(c *websocket.Conn, topic string)
+	OnDisconnect func(c *websocket.Conn, err error)
+
+	shardCount int
+	shards     []*shard
+
+	mu      sync.RWMutex
+	clients map[*websocket.Conn]*subscriber
+}
+
+type shard struct {
+	mu     sync.RWMutex
+	topics map[string]map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	conn      *websocket.Conn
+	send      chan outgoing
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	topics map[string]struct{}
+}
+
+type outgoing struct {
+	msgType int
+	payload []byte
+}
+
+// New returns a Hub sharding its per-topic subscriber maps across
+// shardCount buckets to reduce lock contention between unrelated topics.
+// shardCount <= 0 is treated as 1.
+func New(shardCount int) *Hub {
+	if shardCount <= 0 {
+		shardCount = 1
+	}
+	h := &Hub{
+		shardCount: shardCount,
+		shards:     make([]*shard, shardCount),
+		clients:    make(map[*websocket.Conn]*subscriber),
+	}
+	for i := range h.shards {
+		h.shards[i] = &shard{topics: make(map[string]map[*subscriber]struct{})}
+	}
+	return h
+}
+
+func (h *Hub) shardFor(topic string) *shard {
+	sum := 0
+	for i := 0; i < len(topic); i++ {
+		sum = sum*31 + int(topic[i])
+	}
+	if sum < 0 {
+		sum = -sum
+	}
+	return h.shards[sum%h.shardCount]
+}
+
+// Register adds c to the hub, subscribed to topics, and starts its write
+// pump. The caller is still responsible for reading from c; UpgradeToHub
+// wraps Register together with a read pump for the common case.
+//
+// Register is a no-op if c is already registered, so a caller that races
+// two Registers for the same connection (or simply forgets to Unregister
+// before re-registering) can't leak the first subscriber's write pump
+// goroutine and channels. Call Unregister first to replace c's topic set.
+func (h *Hub) Register(c *websocket.Conn, topics ...string) {
+	sendBuffer := h.SendBuffer
+	if sendBuffer <= 0 {
+		sendBuffer = 16
+	}
+
+	h.mu.Lock()
+	if _, exists := h.clients[c]; exists {
+		h.mu.Unlock()
+		return
+	}
+	sub := &subscriber{
+		conn:   c,
+		send:   make(chan outgoing, sendBuffer),
+		done:   make(chan struct{}),
+		topics: make(map[string]struct{}),
+	}
+	h.clients[c] = sub
+	h.mu.Unlock()
+
+	for _, topic := range topics {
+		h.Subscribe(c, topic)
+	}
+
+	go h.writePump(sub)
+}
+
+// Unregister removes c from the hub and every topic it was subscribed to,
+// and stops its write pump. It is safe to call more than once for the same
+// connection.
+func (h *Hub) Unregister(c *websocket.Conn) {
+	h.mu.Lock()
+	sub, ok := h.clients[c]
+	if ok {
+		delete(h.clients, c)
+	}
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	sub.mu.Lock()
+	topics := make([]string, 0, len(sub.topics))
+	for topic := range sub.topics {
+		topics = append(topics, topic)
+	}
+	sub.mu.Unlock()
+
+	for _, topic := range topics {
+		s := h.shardFor(topic)
+		s.mu.Lock()
+		if subs, present := s.topics[topic]; present {
+			delete(subs, sub)
+			if len(subs) == 0 {
+				delete(s.topics, topic)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	sub.closeOnce.Do(func() { close(sub.done) })
+}
+
+// Subscribe adds c, which must already be registered, to topic.
+func (h *Hub) Subscribe(c *websocket.Conn, topic string) {
+	h.mu.RLock()
+	sub, ok := h.clients[c]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	s := h.shardFor(topic)
+	s.mu.Lock()
+	subs := s.topics[topic]
+	if subs == nil {
+		subs = make(map[*subscriber]struct{})
+		s.topics[topic] = subs
+	}
+	subs[sub] = struct{}{}
+	s.mu.Unlock()
+
+	sub.mu.Lock()
+	sub.topics[topic] = struct{}{}
+	sub.mu.Unlock()
+}
+
+// Unsubscribe removes c from topic.
+func (h *Hub) Unsubscribe(c *websocket.Conn, topic string) {
+	h.mu.RLock()
+	sub, ok := h.clients[c]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	s := h.shardFor(topic)
+	s.mu.Lock()
+	if subs, present := s.topics[topic]; present {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(s.topics, topic)
+		}
+	}
+	s.mu.Unlock()
+
+	sub.mu.Lock()
+	delete(sub.topics, topic)
+	sub.mu.Unlock()
+}
+
+// Publish delivers payload to every connection currently subscribed to
+// topic. It never blocks on a slow subscriber: once that subscriber's
+// buffer is full, SlowClientPolicy decides whether to drop the oldest
+// buffered message, drop this one, or close the connection.
+func (h *Hub) Publish(topic string, msgType int, payload []byte) {
+	s := h.shardFor(topic)
+	s.mu.RLock()
+	subs := make([]*subscriber, 0, len(s.topics[topic]))
+	for sub := range s.topics[topic] {
+		subs = append(subs, sub)
+	}
+	s.mu.RUnlock()
+
+	msg := outgoing{msgType: msgType, payload: payload}
+	delivered := 0
+	for _, sub := range subs {
+		if h.enqueue(sub, topic, msg) {
+			delivered++
+		}
+	}
+	if h.OnPublish != nil {
+		h.OnPublish(topic, delivered)
+	}
+}
+
+func (h *Hub) enqueue(sub *subscriber, topic string, msg outgoing) bool {
+	select {
+	case sub.send <- msg:
+		return true
+	default:
+	}
+
+	switch h.SlowClientPolicy {
+	case DropNewest:
+		if h.OnDrop != nil {
+			h.OnDrop(sub.conn, topic)
+		}
+		return false
+	case CloseSlowClient:
+		if h.OnDrop != nil {
+			h.OnDrop(sub.conn, topic)
+		}
+		h.Unregister(sub.conn)
+		sub.conn.Close()
+		return false
+	default: // DropOldest
+		select {
+		case <-sub.send:
+			if h.OnDrop != nil {
+				h.OnDrop(sub.conn, topic)
+			}
+		default:
+		}
+		select {
+		case sub.send <- msg:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func (h *Hub) writePump(sub *subscriber) {
+	for {
+		select {
+		case msg, ok := <-sub.send:
+			if !ok {
+				return
+			}
+			if err := sub.conn.WriteMessage(msg.msgType, msg.payload); err != nil {
+				if h.OnDisconnect != nil {
+					h.OnDisconnect(sub.conn, err)
+				}
+				h.Unregister(sub.conn)
+				sub.conn.Close()
+				return
+			}
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// Shutdown sends a close frame to every connected peer, unregisters and
+// closes them, and returns ctx.Err() if ctx is canceled or its deadline
+// passes before every peer has been closed; peers not yet reached at that
+// point are left registered for a later Shutdown call.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	conns := make([]*websocket.Conn, 0, len(h.clients))
+	for c := range h.clients {
+		conns = append(conns, c)
+	}
+	h.mu.Unlock()
+
+	closeDeadline := time.Now().Add(time.Second)
+	if deadline, ok := ctx.Deadline(); ok {
+		closeDeadline = deadline
+	}
+
+	for _, c := range conns {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		c.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "server shutting down"),
+			closeDeadline)
+		h.Unregister(c)
+		c.Close()
+	}
+
+	return ctx.Err()
+}
+
+// OnMessage handles one inbound message read from a hub-registered
+// connection. Returning a non-nil error stops the read pump, the same way a
+// UpgraderFs.UpgradeHandler handler would.
+type OnMessage func(c *websocket.Conn, msgType int, payload []byte) error
+
+// UpgradeToHub upgrades ctx to a websocket connection, registers it with h
+// under topics, and runs its read pump until the connection closes or
+// onMessage returns an error, so callers don't have to reimplement the
+// read/write pump plumbing UpgraderFs.UpgradeHandler expects of its
+// handler. Like UpgradeHandler, it returns before the read pump starts:
+// the pump runs in fasthttp's hijack callback, and the returned error only
+// reports a failed handshake.
+//
+// It is a package-level function taking *websocket.UpgraderFs rather than a
+// method on UpgraderFs because UpgraderFs lives in the websocket package,
+// which this package imports; a method would create an import cycle.
+func UpgradeToHub(u *websocket.UpgraderFs, ctx *fasthttp.RequestCtx, h *Hub, topics []string, onMessage OnMessage) error {
+	return u.UpgradeHandler(ctx, func(c *websocket.Conn) error {
+		h.Register(c, topics...)
+		defer h.Unregister(c)
+
+		for {
+			mt, payload, err := c.ReadMessage()
+			if err != nil {
+				return err
+			}
+			if onMessage != nil {
+				if err := onMessage(c, mt, payload); err != nil {
+					return err
+				}
+			}
+		}
+	}, fasthttp.ResponseHeader{})
+}
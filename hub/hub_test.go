@@ -0,0 +1,114 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/vlansco/websocket"
+)
+
+// newTestSubscriber inserts a subscriber for c directly into h, bypassing
+// Register's writePump goroutine so tests can inspect sub.send without a
+// real *websocket.Conn able to service WriteMessage/Close calls.
+func newTestSubscriber(h *Hub, c *websocket.Conn, buffer int) *subscriber {
+	sub := &subscriber{
+		conn:   c,
+		send:   make(chan outgoing, buffer),
+		done:   make(chan struct{}),
+		topics: make(map[string]struct{}),
+	}
+	h.mu.Lock()
+	h.clients[c] = sub
+	h.mu.Unlock()
+	return sub
+}
+
+func TestEnqueueDropOldest(t *testing.T) {
+	h := New(1)
+	h.SlowClientPolicy = DropOldest
+	c := &websocket.Conn{}
+	sub := newTestSubscriber(h, c, 2)
+
+	var dropped int
+	h.OnDrop = func(*websocket.Conn, string) { dropped++ }
+
+	for i := byte(0); i < 3; i++ {
+		h.enqueue(sub, "t", outgoing{payload: []byte{i}})
+	}
+	if dropped != 1 {
+		t.Fatalf("dropped = %d, want 1", dropped)
+	}
+	first := <-sub.send
+	if first.payload[0] != 1 {
+		t.Fatalf("oldest message should have been dropped, got payload %v first", first.payload)
+	}
+}
+
+func TestEnqueueDropNewest(t *testing.T) {
+	h := New(1)
+	h.SlowClientPolicy = DropNewest
+	c := &websocket.Conn{}
+	sub := newTestSubscriber(h, c, 2)
+
+	var dropped int
+	h.OnDrop = func(*websocket.Conn, string) { dropped++ }
+
+	for i := byte(0); i < 3; i++ {
+		h.enqueue(sub, "t", outgoing{payload: []byte{i}})
+	}
+	if dropped != 1 {
+		t.Fatalf("dropped = %d, want 1", dropped)
+	}
+	first := <-sub.send
+	if first.payload[0] != 0 {
+		t.Fatalf("first buffered message should be kept, got payload %v first", first.payload)
+	}
+}
+
+func TestUnregisterRemovesTopicsAndStopsPump(t *testing.T) {
+	h := New(4)
+	c := &websocket.Conn{}
+	sub := newTestSubscriber(h, c, 1)
+
+	for _, topic := range []string{"a", "b", "c"} {
+		h.Subscribe(c, topic)
+	}
+
+	h.Unregister(c)
+
+	for _, topic := range []string{"a", "b", "c"} {
+		s := h.shardFor(topic)
+		s.mu.RLock()
+		_, present := s.topics[topic]
+		s.mu.RUnlock()
+		if present {
+			t.Fatalf("topic %q still present in its shard after Unregister", topic)
+		}
+	}
+
+	select {
+	case <-sub.done:
+	default:
+		t.Fatal("expected sub.done to be closed after Unregister")
+	}
+}
+
+func TestRegisterTwiceIsANoOp(t *testing.T) {
+	h := New(1)
+	c := &websocket.Conn{}
+
+	h.Register(c, "a")
+	h.mu.RLock()
+	first := h.clients[c]
+	h.mu.RUnlock()
+
+	h.Register(c, "b")
+	h.mu.RLock()
+	second := h.clients[c]
+	h.mu.RUnlock()
+
+	if first != second {
+		t.Fatal("second Register replaced the first subscriber instead of being a no-op")
+	}
+
+	h.Unregister(c)
+}
@@ -1,9 +1,12 @@
 package websocket
 
 import (
+	"bufio"
+	"io"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -16,7 +19,9 @@ type HandshakeErrorFs struct {
 func (e HandshakeErrorFs) Error() string { return e.message }
 
 type UpgraderFs struct {
-	// HandshakeTimeout specifies the duration for the handshake to complete.
+	// HandshakeTimeout specifies the duration for the handshake to complete,
+	// gating the write of the 101 response: if the write doesn't finish
+	// within this duration, it fails and the upgrade is aborted.
 	HandshakeTimeout time.Duration
 
 	// ReadBufferSize and WriteBufferSize specify I/O buffer sizes. If a buffer
@@ -36,17 +41,37 @@ type UpgraderFs struct {
 	// Error func(w http.ResponseWriter, r *http.Request, status int, reason error)
 	Error func(ctx *fasthttp.RequestCtx, status int, reason error)
 
-	// CheckOrigin returns true if the request Origin header is acceptable. If
-	// CheckOrigin is nil, the host in the Origin header must not be set or
+	// CheckOrigin returns true if the request's Origin header(s) are
+	// acceptable. origins holds every Origin header value sent by the
+	// client, already parsed; a request normally carries at most one, but
+	// proxies sometimes add more. If CheckOrigin is nil, every origin's host
 	// must match the host of the request.
-	// CheckOrigin func(r *http.Request) bool
-	CheckOrigin func(ctx *fasthttp.RequestCtx) bool
+	CheckOrigin func(ctx *fasthttp.RequestCtx, origins []*url.URL) bool
 
 	// EnableCompression specify if the server should attempt to negotiate per
 	// message compression (RFC 7692). Setting this value to true does not
-	// guarantee that compression will be supported. Currently only "no context
-	// takeover" modes are supported.
+	// guarantee that compression will be supported.
 	EnableCompression bool
+
+	// CompressionLevel is the flate compression level used once
+	// permessage-deflate is negotiated with server context takeover. Valid
+	// values are flate.BestSpeed through flate.BestCompression, or
+	// flate.DefaultCompression. Zero uses flate.DefaultCompression. When
+	// server_no_context_takeover is negotiated, messages are compressed by
+	// compressNoContextTakeover and this field is not used.
+	CompressionLevel int
+
+	// CompressionThreshold is the minimum outgoing message size, in bytes,
+	// below which Conn skips compression even though permessage-deflate was
+	// negotiated. It exists because the deflate framing overhead can make
+	// compression a net loss for small frames.
+	CompressionThreshold int
+
+	// PerMessageDeflate configures the permessage-deflate extension offered
+	// when EnableCompression is true. The zero value accepts the client's
+	// offer as made, so context takeover stays enabled in each direction
+	// unless the client asks for *_no_context_takeover.
+	PerMessageDeflate PerMessageDeflate
 }
 
 func (u *UpgraderFs) returnError(ctx *fasthttp.RequestCtx, status int, reason string) error {
@@ -60,16 +85,69 @@ func (u *UpgraderFs) returnError(ctx *fasthttp.RequestCtx, status int, reason st
 	return err
 }
 
-func checkSameOriginFs(ctx *fasthttp.RequestCtx) bool {
-	origin := ctx.Request.Header.Peek("Origin")
-	if len(origin) == 0 {
+func checkSameOriginFs(ctx *fasthttp.RequestCtx, origins []*url.URL) bool {
+	if len(origins) == 0 {
 		return true
 	}
-	u, err := url.Parse(string(origin))
-	if err != nil {
-		return false
+	host := string(ctx.Host())
+	for _, o := range origins {
+		if o.Host != host {
+			return false
+		}
+	}
+	return true
+}
+
+// Origin returns the client's Origin header values, parsed as URLs. A
+// request ordinarily carries at most one Origin header, but intermediaries
+// occasionally add more; CheckOrigin implementations should judge all of
+// them rather than assuming a single value.
+func Origin(ctx *fasthttp.RequestCtx) ([]*url.URL, error) {
+	raw := ctx.Request.Header.PeekAll("Origin")
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	origins := make([]*url.URL, 0, len(raw))
+	for _, o := range raw {
+		u, err := url.Parse(string(o))
+		if err != nil {
+			return nil, err
+		}
+		origins = append(origins, u)
+	}
+	return origins, nil
+}
+
+// AllowedOrigins returns a CheckOrigin function that accepts a request only
+// if every Origin header it carries matches one of patterns. A pattern is
+// either an exact host (optionally including a port, e.g. "example.com:8443")
+// or a wildcard subdomain such as "*.example.com", which matches any host
+// ending in ".example.com".
+func AllowedOrigins(patterns []string) func(ctx *fasthttp.RequestCtx, origins []*url.URL) bool {
+	return func(ctx *fasthttp.RequestCtx, origins []*url.URL) bool {
+		for _, o := range origins {
+			if !matchesAnyOrigin(o.Host, patterns) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func matchesAnyOrigin(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchesOriginPattern(host, pattern) {
+			return true
+		}
 	}
-	return u.Host == string(ctx.Host())
+	return false
+}
+
+func matchesOriginPattern(host, pattern string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
 }
 
 func (u *UpgraderFs) selectSubprotocol(ctx *fasthttp.RequestCtx, responseHeader fasthttp.ResponseHeader) string {
@@ -88,29 +166,42 @@ func (u *UpgraderFs) selectSubprotocol(ctx *fasthttp.RequestCtx, responseHeader
 	return ""
 }
 
-func (u *UpgraderFs) Upgrade(ctx *fasthttp.RequestCtx, handler func(*Conn) error, responseHeader fasthttp.ResponseHeader) error {
-	var requestHeaderMap = parseHttpHeader(string(ctx.Request.Header.Header()))
-	var responseHeaderMap = parseHttpHeader(string(responseHeader.Header()))
+// negotiation holds what the handshake checks decided, so it can be carried
+// from checkHandshake into the code that actually takes over the
+// connection, without redoing the checks for each of Upgrade and
+// UpgradeHandler.
+type negotiation struct {
+	subprotocol string
+	compress    bool
+	acceptedExt map[string]string
+}
+
+// checkHandshake validates the handshake request, negotiates a subprotocol
+// and permessage-deflate parameters, and stages the response headers onto
+// ctx.Response. It returns a non-nil error (already reported via u.Error or
+// ctx.Error) if the handshake is invalid.
+func (u *UpgraderFs) checkHandshake(ctx *fasthttp.RequestCtx, responseHeader fasthttp.ResponseHeader) (negotiation, error) {
+	var requestHeaderMap = requestHeaderValues(&ctx.Request.Header)
+	var responseHeaderMap = responseHeaderValues(responseHeader)
 
 	if string(ctx.Method()) != "GET" {
-		return u.returnError(ctx, fasthttp.StatusMethodNotAllowed, "websocket: not a websocket handshake: request method is not GET")
+		return negotiation{}, u.returnError(ctx, fasthttp.StatusMethodNotAllowed, "websocket: not a websocket handshake: request method is not GET")
 	}
 
 	if responseHeader.Peek("Sec-Websocket-Extensions") != nil {
-		return u.returnError(ctx, fasthttp.StatusInternalServerError, "websocket: application specific 'Sec-Websocket-Extensions' headers are unsupported")
+		return negotiation{}, u.returnError(ctx, fasthttp.StatusInternalServerError, "websocket: application specific 'Sec-Websocket-Extensions' headers are unsupported")
 	}
 
 	if !tokenListContainsValue(requestHeaderMap, "Connection", "upgrade") {
-		return u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: not a websocket handshake: 'upgrade' token not found in 'Connection' header")
-
+		return negotiation{}, u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: not a websocket handshake: 'upgrade' token not found in 'Connection' header")
 	}
 
 	if !tokenListContainsValue(requestHeaderMap, "Upgrade", "websocket") {
-		return u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: not a websocket handshake: 'websocket' token not found in 'Upgrade' header")
+		return negotiation{}, u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: not a websocket handshake: 'websocket' token not found in 'Upgrade' header")
 	}
 
 	if !tokenListContainsValue(requestHeaderMap, "Sec-Websocket-Version", "13") {
-		return u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: unsupported version: 13 not found in 'Sec-Websocket-Version' header")
+		return negotiation{}, u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: unsupported version: 13 not found in 'Sec-Websocket-Version' header")
 	}
 
 	checkOrigin := u.CheckOrigin
@@ -118,47 +209,54 @@ func (u *UpgraderFs) Upgrade(ctx *fasthttp.RequestCtx, handler func(*Conn) error
 		checkOrigin = checkSameOriginFs
 	}
 
-	if !checkOrigin(ctx) {
-		return u.returnError(ctx, fasthttp.StatusForbidden, "websocket: 'Origin' header value not allowed")
+	origins, err := Origin(ctx)
+	if err != nil {
+		return negotiation{}, u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: invalid 'Origin' header")
+	}
+
+	if !checkOrigin(ctx, origins) {
+		return negotiation{}, u.returnError(ctx, fasthttp.StatusForbidden, "websocket: 'Origin' header value not allowed")
 	}
 
 	challengeKey := string(ctx.Request.Header.Peek("Sec-Websocket-Key"))
 	if challengeKey == "" {
-		return u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: not a websocket handshake: `Sec-Websocket-Key' header is missing or blank")
+		return negotiation{}, u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: not a websocket handshake: `Sec-Websocket-Key' header is missing or blank")
 	}
 
-	subprotocol := u.selectSubprotocol(ctx, responseHeader)
+	n := negotiation{subprotocol: u.selectSubprotocol(ctx, responseHeader)}
 
-	var compress bool
 	if u.EnableCompression {
 		for _, ext := range parseExtensions(requestHeaderMap) {
 			if ext[""] != "permessage-deflate" {
 				continue
 			}
-			compress = true
+			acceptedExt, ok := negotiatePerMessageDeflate(ext, u.PerMessageDeflate)
+			if !ok {
+				return negotiation{}, u.returnError(ctx, fasthttp.StatusBadRequest, "websocket: invalid permessage-deflate parameters")
+			}
+			n.compress = true
+			n.acceptedExt = acceptedExt
 			break
 		}
 	}
 
-	var err error
-
 	ctx.Response.Header.Set("Upgrade", "websocket")
 	ctx.Response.Header.Set("Connection", "Upgrade")
 	ctx.Response.Header.Set("Sec-WebSocket-Accept", computeAcceptKey(challengeKey))
 
-	if subprotocol == "" {
+	if n.subprotocol == "" {
 		// Find the best protocol, if any
 		clientProtocols := SubprotocolsFs(ctx)
 		if len(clientProtocols) != 0 {
-			subprotocol = matchSubprotocol(clientProtocols, u.Subprotocols)
-			if subprotocol != "" {
-				ctx.Response.Header.Set("Sec-Websocket-Protocol", subprotocol)
+			n.subprotocol = matchSubprotocol(clientProtocols, u.Subprotocols)
+			if n.subprotocol != "" {
+				ctx.Response.Header.Set("Sec-Websocket-Protocol", n.subprotocol)
 			}
 		}
 	}
 
-	if compress {
-		ctx.Response.Header.Set("Sec-Websocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	if n.compress {
+		ctx.Response.Header.Set("Sec-Websocket-Extensions", formatPerMessageDeflate(n.acceptedExt))
 	}
 	for k, vs := range responseHeaderMap {
 		if k == "Sec-Websocket-Protocol" {
@@ -168,28 +266,133 @@ func (u *UpgraderFs) Upgrade(ctx *fasthttp.RequestCtx, handler func(*Conn) error
 	}
 	ctx.Response.Header.SetStatusCode(fasthttp.StatusSwitchingProtocols)
 
-	ctx.Hijack(func(netConn net.Conn) {
-		c := newConn(netConn, true, u.ReadBufferSize, u.WriteBufferSize)
-		c.subprotocol = subprotocol
-		if compress {
-			c.newCompressionWriter = compressNoContextTakeover
+	return n, nil
+}
+
+// takeOver runs once the connection has been hijacked: it writes the
+// already-staged 101 response itself (ctx.HijackSetNoResponse suppresses
+// fasthttp's own write, which is what lets HandshakeTimeout actually gate
+// it), then builds the Conn.
+func (u *UpgraderFs) takeOver(ctx *fasthttp.RequestCtx, netConn net.Conn, n negotiation) (*Conn, error) {
+	// Clear deadlines set by the HTTP server before imposing our own.
+	netConn.SetDeadline(time.Time{})
+
+	if u.HandshakeTimeout > 0 {
+		netConn.SetWriteDeadline(time.Now().Add(u.HandshakeTimeout))
+	}
+
+	bw := bufio.NewWriter(netConn)
+	if err := ctx.Response.Write(bw); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	// The handshake succeeded; only now is it safe to lift the deadline
+	// that was guarding the write above.
+	if u.HandshakeTimeout > 0 {
+		netConn.SetWriteDeadline(time.Time{})
+	}
+
+	c := newConn(netConn, true, u.ReadBufferSize, u.WriteBufferSize)
+	c.subprotocol = n.subprotocol
+	if n.compress {
+		var cw func(io.WriteCloser) (io.WriteCloser, error)
+		if _, noContextTakeover := n.acceptedExt["server_no_context_takeover"]; noContextTakeover {
+			cw = compressNoContextTakeover
+		} else {
+			cw = newContextTakeoverCompressor(effectiveCompressionLevel(u.CompressionLevel))
+		}
+		if u.CompressionThreshold > 0 {
+			cw = newThresholdCompressionWriter(u.CompressionThreshold, cw)
+		}
+		c.newCompressionWriter = cw
+
+		if _, noContextTakeover := n.acceptedExt["client_no_context_takeover"]; noContextTakeover {
 			c.newDecompressionReader = decompressNoContextTakeover
+		} else {
+			c.newDecompressionReader = newContextTakeoverDecompressor()
 		}
+	}
+	return c, nil
+}
+
+// Upgrade validates the handshake and, on success, hijacks ctx's connection
+// and returns the resulting Conn synchronously.
+//
+// fasthttp only invokes a Hijack callback after the fasthttp.RequestHandler
+// that owns ctx has returned, so Upgrade must not be called as the last
+// blocking statement of that handler - doing so deadlocks, since the
+// handler can't return until Upgrade does, and Upgrade can't return until
+// the handler does. Call it from a goroutine the handler itself does not
+// wait on instead:
+//
+//	func handleWS(ctx *fasthttp.RequestCtx) {
+//	    go func() {
+//	        conn, err := upgrader.Upgrade(ctx, nil)
+//	        if err != nil {
+//	            return
+//	        }
+//	        defer conn.Close()
+//	        // use conn
+//	    }()
+//	}
+//
+// Callers that want the simpler, deadlock-free form where the connection's
+// lifetime is scoped to the handler should use UpgradeHandler instead.
+func (u *UpgraderFs) Upgrade(ctx *fasthttp.RequestCtx, responseHeader fasthttp.ResponseHeader) (*Conn, error) {
+	n, err := u.checkHandshake(ctx, responseHeader)
+	if err != nil {
+		return nil, err
+	}
 
-		// Clear deadlines set by HTTP server.
-		netConn.SetDeadline(time.Time{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var conn *Conn
+	var hijackErr error
 
-		if u.HandshakeTimeout > 0 {
-			netConn.SetWriteDeadline(time.Now().Add(u.HandshakeTimeout))
-		}
-		if u.HandshakeTimeout > 0 {
-			netConn.SetWriteDeadline(time.Time{})
+	ctx.HijackSetNoResponse(true)
+	ctx.Hijack(func(netConn net.Conn) {
+		defer wg.Done()
+		conn, hijackErr = u.takeOver(ctx, netConn, n)
+	})
+	wg.Wait()
+
+	return conn, hijackErr
+}
+
+// UpgradeHandler validates the handshake, hijacks ctx's connection, and runs
+// handler on the resulting Conn. It is the callback-based counterpart of
+// Upgrade, and unlike Upgrade it is safe to call as the last statement of a
+// fasthttp.RequestHandler: its returned error only ever reflects the
+// handshake validation done before the hijack (a non-websocket request, a
+// bad Origin, ...), not handler's outcome.
+//
+// handler runs inside fasthttp's hijack callback, which fires only after
+// this method - and the fasthttp.RequestHandler that called it - have
+// returned. Blocking here for handler's own error would therefore deadlock
+// exactly the callers this method exists for, so handler's error cannot be
+// surfaced through this method's return value; have handler report its own
+// errors (logging, an OnDisconnect-style hook, a channel it owns) if it
+// needs to.
+func (u *UpgraderFs) UpgradeHandler(ctx *fasthttp.RequestCtx, handler func(*Conn) error, responseHeader fasthttp.ResponseHeader) error {
+	n, err := u.checkHandshake(ctx, responseHeader)
+	if err != nil {
+		return err
+	}
+
+	ctx.HijackSetNoResponse(true)
+	ctx.Hijack(func(netConn net.Conn) {
+		c, hijackErr := u.takeOver(ctx, netConn, n)
+		if hijackErr != nil {
+			return
 		}
 		if handler != nil {
-			err = handler(c)
+			handler(c)
 		}
 	})
-	return err
+	return nil
 }
 
 func UpgradeFs(ctx *fasthttp.RequestCtx, responseHeader fasthttp.ResponseHeader, handler func(*Conn) error, readBufSize, writeBufSize int) error {
@@ -197,11 +400,11 @@ func UpgradeFs(ctx *fasthttp.RequestCtx, responseHeader fasthttp.ResponseHeader,
 	u.Error = func(ctx *fasthttp.RequestCtx, status int, reason error) {
 		// don't return errors to maintain backwards compatibility
 	}
-	u.CheckOrigin = func(ctx *fasthttp.RequestCtx) bool {
+	u.CheckOrigin = func(ctx *fasthttp.RequestCtx, origins []*url.URL) bool {
 		// allow all connections by default
 		return true
 	}
-	return u.Upgrade(ctx, handler, responseHeader)
+	return u.UpgradeHandler(ctx, handler, responseHeader)
 }
 
 func SubprotocolsFs(ctx *fasthttp.RequestCtx) []string {
@@ -217,26 +420,32 @@ func SubprotocolsFs(ctx *fasthttp.RequestCtx) []string {
 }
 
 func IsWebSocketUpgradeFs(ctx *fasthttp.RequestCtx) bool {
-	var requestHeaderMap = parseHttpHeader(string(ctx.Request.Header.Header()))
+	var requestHeaderMap = requestHeaderValues(&ctx.Request.Header)
 
 	return tokenListContainsValue(requestHeaderMap, "Connection", "upgrade") &&
 		tokenListContainsValue(requestHeaderMap, "Upgrade", "websocket")
 }
 
-// a new func added to parse http raw content
-func parseHttpHeader(content string) map[string][]string {
+// requestHeaderValues collects every value sent for each request header,
+// keyed by header name. Unlike re-serializing the header block and
+// splitting on ":", VisitAll hands back fasthttp's already-parsed key/value
+// pairs, so header values containing colons (Origin URLs with a port,
+// Sec-Websocket-Protocol tokens, ...) survive intact.
+func requestHeaderValues(h *fasthttp.RequestHeader) map[string][]string {
 	headers := make(map[string][]string, 10)
-	lines := strings.Split(content, "\r\n")
-	for _, line := range lines {
-		if len(line) >= 0 {
-			words := strings.Split(line, ":")
-			if len(words) == 2 {
-				key := strings.Trim(words[0], " ")
-				value := strings.Trim(words[1], " ")
-				headers[key] = append(headers[key], value)
-			}
-		}
-	}
+	h.VisitAll(func(key, value []byte) {
+		headers[string(key)] = append(headers[string(key)], string(value))
+	})
+	return headers
+}
+
+// responseHeaderValues is the fasthttp.ResponseHeader counterpart of
+// requestHeaderValues.
+func responseHeaderValues(h fasthttp.ResponseHeader) map[string][]string {
+	headers := make(map[string][]string, 10)
+	h.VisitAll(func(key, value []byte) {
+		headers[string(key)] = append(headers[string(key)], string(value))
+	})
 	return headers
 }
 
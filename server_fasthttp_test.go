@@ -0,0 +1,58 @@
+package websocket
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestTakeOverWritesStagedResponse(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+	ctx.Response.Header.Set("Upgrade", "websocket")
+	ctx.Response.Header.Set("Connection", "Upgrade")
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	read := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 512)
+		n, _ := client.Read(buf)
+		read <- buf[:n]
+	}()
+
+	u := &UpgraderFs{HandshakeTimeout: time.Second}
+	conn, err := u.takeOver(&ctx, server, negotiation{})
+	if err != nil {
+		t.Fatalf("takeOver: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case data := <-read:
+		if len(data) == 0 {
+			t.Fatal("expected a non-empty 101 response on the wire")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for takeOver to write the response")
+	}
+}
+
+func TestTakeOverEnforcesHandshakeTimeout(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Nobody reads from client, so the unbuffered pipe blocks the write
+	// inside takeOver until the deadline HandshakeTimeout installs fires.
+	u := &UpgraderFs{HandshakeTimeout: 20 * time.Millisecond}
+	if _, err := u.takeOver(&ctx, server, negotiation{}); err == nil {
+		t.Fatal("expected takeOver to fail once the handshake timeout elapsed")
+	}
+}